@@ -0,0 +1,125 @@
+package pqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPromoteInterval is used by Promoter when
+// Options.PromoteInterval is zero.
+const DefaultPromoteInterval = time.Second
+
+// SubmitAt moves a job (created by CreateJob) into the `delayed`
+// subdirectory so that it becomes available to workers at t rather
+// than immediately. The wakeup time is wall-clock time on whichever
+// host runs the Promoter, so clocks across hosts sharing the queue
+// should be kept roughly in sync. A t already in the past is promoted
+// the next time Promoter scans.
+func (job *Job) SubmitAt(t time.Time) error {
+	q := job.q
+	basename := fmt.Sprintf("%d-%s", t.UnixNano(), stripDelayPrefix(job.Basename))
+	d := path.Join(q.getDelayedDir(), basename)
+	if err := os.Rename(job.dir, d); err != nil {
+		return err
+	}
+	job.dir = d
+	job.Basename = basename
+	return nil
+}
+
+// SubmitAfter is SubmitAt(time.Now().Add(d)).
+func (job *Job) SubmitAfter(d time.Duration) error {
+	return job.SubmitAt(time.Now().Add(d))
+}
+
+// Reschedule moves a job a worker has taken back into `delayed`, to
+// be retaken after d. It is meant for a worker that wants to defer a
+// job it currently holds rather than finishing or failing it.
+func (job *Job) Reschedule(d time.Duration) error {
+	return job.SubmitAt(time.Now().Add(d))
+}
+
+// Promoter scans the `delayed` subdirectory for jobs whose time has
+// arrived and renames them into `new`, where Take/TakeContext will
+// find them. It runs until ctx is done, at which point it returns
+// ctx.Err(). Run it in its own goroutine, e.g. `go q.Promoter(ctx)`.
+// It is safe to run a Promoter per host against a shared queue
+// directory; the rename used to promote a job is atomic, so racing
+// promoters cannot double-promote it.
+func (q *Queue) Promoter(ctx context.Context) error {
+	ticker := time.NewTicker(q.promoteInterval)
+	defer ticker.Stop()
+	for {
+		if err := q.promoteDue(); err != nil {
+			q.logger.Errorw("failed to scan delayed jobs", err, "queue_dir", q.basedir, "op", "promote")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// promoteDue moves every job in `delayed` whose wakeup time has
+// arrived into `new` (or its lane, if any - see Job.lane and
+// Queue.jobLane). It reads the wakeup time out of the job's filename
+// rather than opening every job, so scanning `delayed` stays cheap
+// even when it holds many jobs that aren't due yet.
+func (q *Queue) promoteDue() error {
+	dir := q.getDelayedDir()
+	names, err := readdirnames(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for _, s := range names {
+		ts, ok := delayedWakeupTime(s)
+		if !ok {
+			q.logger.Infow("ignoring malformed delayed job name", "job", s, "queue_dir", q.basedir, "op", "promote")
+			continue
+		}
+		if ts > now {
+			continue
+		}
+		src := path.Join(dir, s)
+		dst := path.Join(q.laneDir("new", q.jobLane(src)), s)
+		if err := os.Rename(src, dst); err != nil {
+			if os.IsNotExist(err) {
+				// Another promoter already moved it.
+				continue
+			}
+			q.logger.Errorw("failed to promote delayed job", err, "job", s, "queue_dir", q.basedir, "op", "promote")
+		}
+	}
+	return nil
+}
+
+func delayedWakeupTime(name string) (int64, bool) {
+	prefix := strings.SplitN(name, "-", 2)[0]
+	ts, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// stripDelayPrefix removes a single leading "<unix-nanos>-" prefix
+// added by a previous SubmitAt, if any, so that rescheduling a job
+// repeatedly (see Reschedule) doesn't chain up an ever-growing stack
+// of timestamp prefixes in its basename.
+func stripDelayPrefix(name string) string {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 {
+		return name
+	}
+	if _, err := strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return name
+	}
+	return parts[1]
+}
@@ -0,0 +1,124 @@
+package pqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSubmitAtPastTimeIsPromotedImmediately(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_submit_at_past_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatal("OpenQueue", err)
+	}
+	defer q.Close()
+
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	if err := j.SubmitAt(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal("failed to SubmitAt:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	q.Promoter(ctx)
+
+	j2, err := q.Take()
+	if err != nil {
+		t.Fatal("failed to take job:", err)
+	}
+	if j2 == nil {
+		t.Fatal("past-due delayed job was not promoted")
+	}
+}
+
+func TestPromoterCancellation(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_promoter_cancel_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatal("OpenQueue", err)
+	}
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Promoter(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Promoter did not return after cancellation")
+	}
+}
+
+func TestConcurrentPromotersDoNotDoublePromote(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_promoters_concurrent_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatal("OpenQueue", err)
+	}
+	defer q.Close()
+
+	const numJobs = 20
+	for i := 0; i < numJobs; i++ {
+		j, err := q.CreateJob("foo")
+		if err != nil {
+			t.Fatal("failed to create job:", err)
+		}
+		if err := j.SubmitAt(time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal("failed to SubmitAt:", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			q.Promoter(ctx)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	names, err := readdirnames(path.Join(q.basedir, "new"))
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(names) != numJobs {
+		t.Fatal("expected", numJobs, "promoted jobs in new, got", len(names))
+	}
+	delayedNames, err := readdirnames(q.getDelayedDir())
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(delayedNames) != 0 {
+		t.Fatal("expected delayed to be empty, got", delayedNames)
+	}
+}
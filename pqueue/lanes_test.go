@@ -0,0 +1,243 @@
+package pqueue
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTakeScansLanesInPriorityOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_lanes_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueueWithOptions(dir, Options{Lanes: []string{"high", "normal", "low"}})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	low, err := q.CreateJobInLane("foo", "low")
+	if err != nil {
+		t.Fatal("CreateJobInLane", err)
+	}
+	if err := low.Submit(); err != nil {
+		t.Fatal("Submit", err)
+	}
+
+	high, err := q.CreateJobInLane("foo", "high")
+	if err != nil {
+		t.Fatal("CreateJobInLane", err)
+	}
+	if err := high.Submit(); err != nil {
+		t.Fatal("Submit", err)
+	}
+
+	taken, err := q.Take()
+	if err != nil {
+		t.Fatal("Take", err)
+	}
+	if taken == nil || taken.Basename != high.Basename {
+		t.Fatal("expected to take the high-lane job first, got", taken)
+	}
+
+	taken2, err := q.Take()
+	if err != nil {
+		t.Fatal("Take", err)
+	}
+	if taken2 == nil || taken2.Basename != low.Basename {
+		t.Fatal("expected to take the low-lane job second, got", taken2)
+	}
+}
+
+func TestCreateJobUsesDefaultLane(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_lanes_default_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueueWithOptions(dir, Options{Lanes: []string{"high", "low"}})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("CreateJob", err)
+	}
+	if j.lane != "high" {
+		t.Fatal("expected CreateJob to use the highest-priority lane, got", j.lane)
+	}
+}
+
+func TestFailWithRetryReschedulesUntilExhausted(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_retry_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueueWithOptions(dir, Options{MaxRetries: 2, RetryBaseDelay: time.Millisecond, PromoteInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("CreateJob", err)
+	}
+	if err := j.Submit(); err != nil {
+		t.Fatal("Submit", err)
+	}
+	taken, err := q.Take()
+	if err != nil {
+		t.Fatal("Take", err)
+	}
+
+	cause := errors.New("boom")
+	for i := 0; i < 2; i++ {
+		if err := taken.FailWithRetry(cause); err != nil {
+			t.Fatal("FailWithRetry", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		q.Promoter(ctx)
+		cancel()
+		taken, err = q.Take()
+		if err != nil {
+			t.Fatal("Take", err)
+		}
+		if taken == nil {
+			t.Fatal("expected job to be retried after attempt", i+1)
+		}
+	}
+
+	// Third failure exhausts MaxRetries and should land in failed/.
+	if err := taken.FailWithRetry(cause); err != nil {
+		t.Fatal("FailWithRetry", err)
+	}
+	if _, err := os.Stat(taken.dir); err != nil {
+		t.Fatal("expected job still present at its final location:", err)
+	}
+	data, err := ioutil.ReadFile(taken.dir + "/_last_error")
+	if err != nil {
+		t.Fatal("expected _last_error to be recorded:", err)
+	}
+	if string(data) != "boom" {
+		t.Fatal("unexpected _last_error contents:", string(data))
+	}
+}
+
+func TestRetriedJobReturnsToItsOriginalLane(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_retry_lane_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueueWithOptions(dir, Options{
+		Lanes:           []string{"high", "low"},
+		MaxRetries:      1,
+		RetryBaseDelay:  time.Millisecond,
+		PromoteInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	j, err := q.CreateJobInLane("foo", "low")
+	if err != nil {
+		t.Fatal("CreateJobInLane", err)
+	}
+	if err := j.Submit(); err != nil {
+		t.Fatal("Submit", err)
+	}
+	taken, err := q.Take()
+	if err != nil {
+		t.Fatal("Take", err)
+	}
+
+	if err := taken.FailWithRetry(errors.New("boom")); err != nil {
+		t.Fatal("FailWithRetry", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	q.Promoter(ctx)
+	cancel()
+
+	if _, err := os.Stat(q.laneDir("new", "high")); err != nil {
+		t.Fatal("stat", err)
+	}
+	names, err := readdirnames(q.laneDir("new", "high"))
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(names) != 0 {
+		t.Fatal("retried job was promoted into the wrong (default) lane:", names)
+	}
+	names, err = readdirnames(q.laneDir("new", "low"))
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(names) != 1 {
+		t.Fatal("expected retried job back in its original lane, got", names)
+	}
+}
+
+func TestRescuedJobReturnsToItsOriginalLane(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_rescue_lane_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueueWithOptions(dir, Options{Lanes: []string{"high", "low"}})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	j, err := q.CreateJobInLane("foo", "low")
+	if err != nil {
+		t.Fatal("CreateJobInLane", err)
+	}
+	if err := j.Submit(); err != nil {
+		t.Fatal("Submit", err)
+	}
+	taken, err := q.Take()
+	if err != nil {
+		t.Fatal("Take", err)
+	}
+
+	// Simulate the worker that took the job dying by moving the job
+	// into a cur/ subdirectory named after a PID that doesn't exist.
+	deadWorkerDir := q.getWorkerDir("424242")
+	if err := os.Mkdir(deadWorkerDir, 0755); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+	if err := os.Rename(taken.dir, path.Join(deadWorkerDir, taken.Basename)); err != nil {
+		t.Fatal("Rename", err)
+	}
+
+	if err := q.RescueDeadJobs(); err != nil {
+		t.Fatal("RescueDeadJobs", err)
+	}
+
+	names, err := readdirnames(q.laneDir("new", "high"))
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(names) != 0 {
+		t.Fatal("rescued job was promoted into the wrong (default) lane:", names)
+	}
+	names, err = readdirnames(q.laneDir("new", "low"))
+	if err != nil {
+		t.Fatal("readdirnames", err)
+	}
+	if len(names) != 1 {
+		t.Fatal("expected rescued job back in its original lane, got", names)
+	}
+}
@@ -0,0 +1,28 @@
+package pqueue
+
+import "log"
+
+// Logger receives structured events from a Queue. Implementations
+// are expected to attach kv (alternating key, value pairs) as
+// structured fields rather than interpolating them into msg, so that
+// events such as "a worker went away" remain machine-parseable. This
+// lets callers plug in zap, zerolog, slog, or similar without this
+// module taking a dependency on any of them; see the pqueueslog
+// subpackage for a `log/slog` adapter.
+type Logger interface {
+	Infow(msg string, kv ...interface{})
+	Errorw(msg string, err error, kv ...interface{})
+}
+
+// stdLogger is the default Logger, a thin adapter over the standard
+// library `log` package used when Options.Logger is not set.
+type stdLogger struct{}
+
+func (stdLogger) Infow(msg string, kv ...interface{}) {
+	log.Println(append([]interface{}{msg}, kv...)...)
+}
+
+func (stdLogger) Errorw(msg string, err error, kv ...interface{}) {
+	args := append([]interface{}{msg, "error", err}, kv...)
+	log.Println(args...)
+}
@@ -0,0 +1,168 @@
+package pqueue
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultRescanInterval is used by TakeContext/Notify when
+// Options.RescanInterval is zero. It bounds how long a blocked
+// TakeContext can go without noticing a new job if filesystem
+// notifications are missed, which happens routinely on NFS.
+const DefaultRescanInterval = 5 * time.Second
+
+// coalesceWindow groups bursts of Create/Rename events (for example,
+// many jobs submitted back to back) into a single wakeup.
+const coalesceWindow = 20 * time.Millisecond
+
+// TakeContext behaves like Take, but instead of returning immediately
+// when `new` is empty, it blocks until a job becomes available or ctx
+// is done. It is woken by filesystem notifications on the `new`
+// directory and, as a fallback for filesystems (such as NFS) where
+// those are unreliable, by a periodic rescan; see
+// Options.RescanInterval.
+func (q *Queue) TakeContext(ctx context.Context) (*Job, error) {
+	q.startWatching()
+	for {
+		job, err := q.Take()
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return job, nil
+		}
+		if err := q.waitForWake(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Notify registers ch to receive a (non-blocking) value every time
+// the queue observes the `new` directory change, so that a caller can
+// drive its own scheduler instead of calling TakeContext. ch also
+// receives a value on every periodic rescan (Options.RescanInterval),
+// whether or not anything changed. ch should be
+// buffered; sends to it are dropped if it is not ready to receive.
+func (q *Queue) Notify(ch chan<- struct{}) {
+	q.notifyMu.Lock()
+	q.subscribers = append(q.subscribers, ch)
+	q.notifyMu.Unlock()
+	q.startWatching()
+}
+
+func (q *Queue) startWatching() {
+	q.watchOnce.Do(func() {
+		q.stopWatch = make(chan struct{})
+		q.watchWg.Add(1)
+		go q.watchLoop()
+	})
+}
+
+func (q *Queue) watchLoop() {
+	defer q.watchWg.Done()
+	watchdirs := []string{q.getNewDir()}
+	for _, lane := range q.lanes {
+		watchdirs = append(watchdirs, q.laneDir("new", lane))
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		q.logger.Errorw("fsnotify unavailable, falling back to polling only", err, "queue_dir", q.basedir, "op", "watch")
+		watcher = nil
+	} else {
+		for _, d := range watchdirs {
+			if err := watcher.Add(d); err != nil {
+				q.logger.Errorw("failed to watch directory", err, "queue_dir", q.basedir, "op", "watch", "dir", d)
+				watcher.Close()
+				watcher = nil
+				break
+			}
+		}
+	}
+	if watcher != nil {
+		defer watcher.Close()
+	}
+
+	ticker := time.NewTicker(q.rescanInterval)
+	defer ticker.Stop()
+
+	var coalesce *time.Timer
+	defer func() {
+		if coalesce != nil {
+			coalesce.Stop()
+		}
+	}()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	for {
+		select {
+		case <-q.stopWatch:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if coalesce == nil {
+				coalesce = time.AfterFunc(coalesceWindow, q.broadcastWake)
+			} else {
+				coalesce.Reset(coalesceWindow)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			q.logger.Errorw("fsnotify error", err, "queue_dir", q.basedir, "op", "watch")
+		case <-ticker.C:
+			q.broadcastWake()
+		}
+	}
+}
+
+func (q *Queue) currentWakeChan() chan struct{} {
+	q.notifyMu.Lock()
+	defer q.notifyMu.Unlock()
+	if q.wake == nil {
+		q.wake = make(chan struct{})
+	}
+	return q.wake
+}
+
+func (q *Queue) broadcastWake() {
+	q.notifyMu.Lock()
+	if q.wake != nil {
+		close(q.wake)
+	}
+	q.wake = make(chan struct{})
+	subscribers := q.subscribers
+	q.notifyMu.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *Queue) waitForWake(ctx context.Context) error {
+	ch := q.currentWakeChan()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,76 @@
+package pqueue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTakeContextBlocksUntilSubmit(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_take_context_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatal("OpenQueue", err)
+	}
+	defer q.Close()
+
+	result := make(chan *Job, 1)
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		job, err := q.TakeContext(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		result <- job
+	}()
+
+	// Give TakeContext a chance to start blocking before we submit.
+	time.Sleep(50 * time.Millisecond)
+
+	j, err := q.CreateJob("foo")
+	if err != nil {
+		t.Fatal("failed to create job:", err)
+	}
+	if err := j.Submit(); err != nil {
+		t.Fatal("failed to submit job:", err)
+	}
+
+	select {
+	case job := <-result:
+		if job.Basename != j.Basename {
+			t.Fatal("didn't get the submitted job back", job, j)
+		}
+	case err := <-errs:
+		t.Fatal("TakeContext failed:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("TakeContext did not wake up after submit")
+	}
+}
+
+func TestTakeContextCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_take_context_cancel_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(dir)
+	if err != nil {
+		t.Fatal("OpenQueue", err)
+	}
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.TakeContext(ctx); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
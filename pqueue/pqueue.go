@@ -13,9 +13,13 @@
 // - The `new` subdirectory contains jobs that workers should process
 // (see the `Take` method).
 //
-// - The `cur` subdirectory contains a subdirectory for each worker
-// (named by its process ID) where jobs are placed while the worker
-// processes them.
+// - The `cur` subdirectory contains a subdirectory for each worker,
+// named by its WorkerID (by default its process ID), where jobs are
+// placed while the worker processes them. See `RescueDeadJobs` for
+// how a dead worker's jobs are noticed and recovered.
+//
+// - The `delayed` subdirectory holds jobs that are not yet visible to
+// workers; see `Job.SubmitAt` and `Queue.Promoter`.
 //
 // - When jobs fail or finish successfully, they are moved to the
 // `failed` or `done` subdirectories, respectively. See the `Fail` and
@@ -31,46 +35,204 @@ package pqueue
 
 import (
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type Queue struct {
-	basedir  string
-	mycurdir string
+	basedir     string
+	mycurdir    string
+	workerID    WorkerID
+	useFileLock bool
+	lockFile    *os.File
+
+	rescanInterval  time.Duration
+	promoteInterval time.Duration
+	watchOnce       sync.Once
+	stopWatch       chan struct{}
+	watchWg         sync.WaitGroup
+
+	notifyMu    sync.Mutex
+	wake        chan struct{}
+	subscribers []chan<- struct{}
+
+	lanes                 []string
+	maxRetries            int
+	retryBaseDelay        time.Duration
+	rescueCountsAsAttempt bool
+
+	logger Logger
 }
 
 type Job struct {
 	Basename string
 	dir      string
 	q        *Queue
+	lane     string
 }
 
-var mycur = path.Join("cur", strconv.Itoa(os.Getpid()))
-
 // Open a pqueue. The directory `dir` must already exist. The
 // subdirectories (`new`, `cur`, etc.) will be created if they are
-// missing.
+// missing. The worker's own `cur` subdirectory is named after its
+// PID, so liveness is checked with `syscall.Kill(pid, 0)`; this only
+// works when all workers run on the same host. For queues shared
+// across hosts, use `OpenQueueWithOptions`.
 func OpenQueue(dir string) (*Queue, error) {
+	return OpenQueueWithOptions(dir, Options{WorkerID: defaultWorkerID()})
+}
+
+// Options control how a Queue identifies and tracks the liveness of
+// the worker that opens it. See `OpenQueueWithOptions`.
+type Options struct {
+	// WorkerID names this worker's subdirectory of `cur`. If empty,
+	// a WorkerID based on the process ID is used.
+	WorkerID WorkerID
+
+	// UseFileLock makes `RescueDeadJobs` determine whether a worker
+	// is still alive by flock(2)'ing a `cur/<WorkerID>.lock` file
+	// instead of sending it signal 0. Unlike a PID check, this works
+	// across hosts (for example, when the queue directory is on an
+	// NFS or SMB share), as long as the filesystem supports fcntl
+	// locks. The worker holds the lock for as long as the Queue is
+	// open; call `Close` to release it.
+	UseFileLock bool
+
+	// RescanInterval bounds how long `TakeContext` can be blocked
+	// without noticing a new job, in case filesystem notifications
+	// are missed (this happens routinely on NFS). Defaults to
+	// `DefaultRescanInterval` if zero.
+	RescanInterval time.Duration
+
+	// PromoteInterval is how often `Promoter` scans `delayed` for
+	// jobs whose time has arrived. Defaults to
+	// `DefaultPromoteInterval` if zero.
+	PromoteInterval time.Duration
+
+	// Lanes names priority lanes under `new`, in descending priority
+	// order (for example, []string{"high", "normal", "low"}). `Take`
+	// scans them in order and picks randomly among the jobs in the
+	// highest-priority non-empty lane, preserving the existing
+	// anti-thundering-herd behavior within that lane. If empty, the
+	// queue has a single unnamed lane, matching the pre-lanes layout
+	// (jobs directly under `new`).
+	Lanes []string
+
+	// MaxRetries is how many times `FailWithRetry` (and, if
+	// RescueCountsAsAttempt is set, `RescueDeadJobs`) will send a job
+	// back for another attempt before giving up and moving it to
+	// `failed`.
+	MaxRetries int
+
+	// RetryBaseDelay is the backoff unit for `FailWithRetry`: the
+	// nth retry is delayed by RetryBaseDelay * 2^(n-1). Defaults to
+	// `DefaultRetryBaseDelay` if zero.
+	RetryBaseDelay time.Duration
+
+	// RescueCountsAsAttempt makes `RescueDeadJobs` charge a rescued
+	// job against MaxRetries, moving it straight to `failed` once
+	// exhausted, instead of unconditionally resubmitting it to `new`.
+	RescueCountsAsAttempt bool
+
+	// Logger receives structured events for operations such as
+	// RescueDeadJobs (dead workers found, jobs rescued) and Set
+	// (property write failures). Defaults to an adapter that writes
+	// to the standard library `log` package. See the `Logger`
+	// interface.
+	Logger Logger
+}
+
+// Open a pqueue the way `OpenQueue` does, but let the caller pick how
+// this worker identifies itself and how its liveness is determined.
+func OpenQueueWithOptions(dir string, opts Options) (*Queue, error) {
 	var q Queue
 	q.basedir = dir
-	for _, d := range []string{"tmp", "new", "cur", "done", "failed", mycur} {
+	q.workerID = opts.WorkerID
+	if q.workerID == "" {
+		q.workerID = defaultWorkerID()
+	}
+	q.useFileLock = opts.UseFileLock
+	q.rescanInterval = opts.RescanInterval
+	if q.rescanInterval <= 0 {
+		q.rescanInterval = DefaultRescanInterval
+	}
+	q.promoteInterval = opts.PromoteInterval
+	if q.promoteInterval <= 0 {
+		q.promoteInterval = DefaultPromoteInterval
+	}
+	q.lanes = opts.Lanes
+	q.maxRetries = opts.MaxRetries
+	q.retryBaseDelay = opts.RetryBaseDelay
+	if q.retryBaseDelay <= 0 {
+		q.retryBaseDelay = DefaultRetryBaseDelay
+	}
+	q.rescueCountsAsAttempt = opts.RescueCountsAsAttempt
+	q.logger = opts.Logger
+	if q.logger == nil {
+		q.logger = stdLogger{}
+	}
+	q.mycurdir = path.Join("cur", string(q.workerID))
+	dirs := []string{"tmp", "new", "cur", "done", "failed", "delayed", q.mycurdir}
+	for _, lane := range q.lanes {
+		dirs = append(dirs, path.Join("new", lane))
+	}
+	for _, d := range dirs {
 		err := ensuredir(q.basedir, d)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if q.useFileLock {
+		f, err := q.acquireLock(q.workerID)
+		if err != nil {
+			return nil, err
+		}
+		q.lockFile = f
+	}
 	return &q, nil
 }
 
+// Release the lock file acquired for this worker, if any
+// (`Options.UseFileLock`). It is safe to call Close on a Queue opened
+// without `UseFileLock`.
+func (q *Queue) Close() error {
+	if q.stopWatch != nil {
+		close(q.stopWatch)
+		q.watchWg.Wait()
+	}
+	if q.lockFile == nil {
+		return nil
+	}
+	err := syscall.Flock(int(q.lockFile.Fd()), syscall.LOCK_UN)
+	cerr := q.lockFile.Close()
+	q.lockFile = nil
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
 // Create a job in the `tmp` directory of the queue. After you finish
 // preparing the job with `Set`, call the `Submit` method to make the
-// job available to workers.
+// job available to workers. The job is created in the queue's
+// default lane (the highest-priority lane given in `Options.Lanes`,
+// or the single unnamed lane if lanes were not configured); use
+// `CreateJobInLane` to target a different lane.
 func (q *Queue) CreateJob(prefix string) (*Job, error) {
+	return q.CreateJobInLane(prefix, q.defaultLane())
+}
+
+// Create a job the way `CreateJob` does, but for the named lane (one
+// of the strings passed as `Options.Lanes` to `OpenQueueWithOptions`).
+// `Submit` moves it into `new/<lane>` rather than plain `new`. The
+// lane is recorded as the `_lane` property so that the job returns to
+// it if it is later delayed, retried, or rescued from a dead worker.
+func (q *Queue) CreateJobInLane(prefix, lane string) (*Job, error) {
 	tmp, err := ioutil.TempDir(path.Join(q.basedir, "tmp"), prefix)
 	if err != nil {
 		return nil, err
@@ -79,13 +241,47 @@ func (q *Queue) CreateJob(prefix string) (*Job, error) {
 	job.Basename = path.Base(tmp)
 	job.dir = tmp
 	job.q = q
+	job.lane = lane
+	if lane != "" {
+		if err := job.Set("_lane", []byte(lane)); err != nil {
+			return nil, err
+		}
+	}
 	return &job, nil
 }
 
-// Move a job (created by `CreateJob` in the `tmp` subdirectory) to
-// the `new` subdirectory so it becomes available to workers.
+func (q *Queue) defaultLane() string {
+	if len(q.lanes) == 0 {
+		return ""
+	}
+	return q.lanes[0]
+}
+
+func (q *Queue) laneDir(kind, lane string) string {
+	if lane == "" {
+		return path.Join(q.basedir, kind)
+	}
+	return path.Join(q.basedir, kind, lane)
+}
+
+// jobLane reads the `_lane` property of the job directory dir,
+// falling back to the queue's default lane if the job has no `_lane`
+// (it predates lanes, or was created in the unnamed lane of a queue
+// without lanes). Used by promoteDue and rescueDeadJobsFrom, which operate
+// on job directories they haven't opened as a *Job.
+func (q *Queue) jobLane(dir string) string {
+	data, err := ioutil.ReadFile(path.Join(dir, "_lane"))
+	if err != nil {
+		return q.defaultLane()
+	}
+	return string(data)
+}
+
+// Move a job (created by `CreateJob`/`CreateJobInLane` in the `tmp`
+// subdirectory) to its lane under the `new` subdirectory so it
+// becomes available to workers.
 func (job *Job) Submit() error {
-	d := path.Join(job.q.basedir, "new", job.Basename)
+	d := path.Join(job.q.laneDir("new", job.lane), job.Basename)
 	err := os.Rename(job.dir, d)
 	if err != nil {
 		return err
@@ -94,12 +290,33 @@ func (job *Job) Submit() error {
 	return nil
 }
 
-// Find an available job (in the `new` subdirectory) and move it to
-// the `cur` subdirectory for this worker process. Returns `nil` if
-// there are no available jobs.
+// Find an available job and move it to the `cur` subdirectory for
+// this worker process. If the queue has priority lanes
+// (`Options.Lanes`), they are scanned in priority order and a job is
+// taken from the highest-priority non-empty lane; otherwise the
+// single unnamed lane (plain `new`) is used. Returns `nil` if there
+// are no available jobs in any lane.
 func (q *Queue) Take() (*Job, error) {
+	lanes := q.lanes
+	if len(lanes) == 0 {
+		lanes = []string{""}
+	}
+	for _, lane := range lanes {
+		job, err := q.takeFromLane(lane)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q *Queue) takeFromLane(lane string) (*Job, error) {
+	newdir := q.laneDir("new", lane)
 	for {
-		names, err := readdirnames(path.Join(q.basedir, "new"))
+		names, err := readdirnames(newdir)
 		if err != nil {
 			return nil, err
 		}
@@ -107,8 +324,8 @@ func (q *Queue) Take() (*Job, error) {
 			return nil, nil
 		}
 		basename := names[rand.Intn(len(names))]
-		d := path.Join(q.basedir, mycur, basename)
-		err = os.Rename(path.Join(q.basedir, "new", basename), d)
+		d := path.Join(q.basedir, q.mycurdir, basename)
+		err = os.Rename(path.Join(newdir, basename), d)
 		if err != nil {
 			if os.IsNotExist(err) {
 				continue
@@ -120,6 +337,7 @@ func (q *Queue) Take() (*Job, error) {
 		job.Basename = basename
 		job.dir = d
 		job.q = q
+		job.lane = lane
 		return &job, nil
 	}
 }
@@ -154,53 +372,91 @@ func (q *Queue) getCurDir() string {
 	return path.Join(q.basedir, "cur")
 }
 
-func (q *Queue) getWorkerDir(pid int) string {
-	return path.Join(q.basedir, "cur", strconv.Itoa(pid))
+func (q *Queue) getDelayedDir() string {
+	return path.Join(q.basedir, "delayed")
+}
+
+func (q *Queue) getWorkerDir(workerID string) string {
+	return path.Join(q.basedir, "cur", workerID)
 }
 
 // Go through the `cur` subdirectory, determine which workers are no
-// longer alove, and resubmit the jobs they were processing when they
-// died.
+// longer alive, and resubmit the jobs they were processing when they
+// died. A worker's entry in `cur` is considered dead if its PID no
+// longer exists (the default) or, if this Queue was opened with
+// `Options.UseFileLock` or the entry's name is not a PID, if its
+// `.lock` file can be flock'd - see `OpenQueueWithOptions`.
 func (q *Queue) RescueDeadJobs() error {
 	curdir := q.getCurDir()
 	names, err := readdirnames(curdir)
 	if err != nil {
-		log.Println("Could not rescue dead jobs: failed to read contents of", curdir)
+		q.logger.Errorw("could not rescue dead jobs: failed to read cur", err, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
 		return err
 	}
 	for _, s := range names {
-		pid, err := strconv.Atoi(s)
-		if err != nil {
-			log.Println("Does not look like a PID:", s, "- error:", err)
+		if strings.HasSuffix(s, ".lock") {
 			continue
 		}
-		exists, err := processExists(pid)
+		dead, err := q.workerIsDead(s)
 		if err != nil {
-			log.Println("Kill failed for PID", pid, "- error:", err)
+			q.logger.Errorw("could not determine worker liveness", err, "worker", s, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
 			continue
 		}
-		if !exists {
-			log.Println("Process", pid, "has gone away")
-			q.rescueDeadJobsFrom(pid)
-			if err := os.Remove(q.getWorkerDir(pid)); err != nil {
-				log.Printf("Failed to rmdir %s: %s", q.getWorkerDir(pid), err)
+		if dead {
+			q.logger.Infow("worker has gone away", "worker", s, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
+			q.rescueDeadJobsFrom(s)
+			if err := os.Remove(q.getWorkerDir(s)); err != nil {
+				q.logger.Errorw("failed to rmdir worker directory", err, "worker", s, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
+			}
+			lockfile := q.getWorkerDir(s) + ".lock"
+			if err := os.Remove(lockfile); err != nil && !os.IsNotExist(err) {
+				q.logger.Errorw("failed to remove lock file", err, "worker", s, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
 			}
 		}
 	}
 	return nil
 }
 
-func (q *Queue) rescueDeadJobsFrom(pid int) {
-	dir := q.getWorkerDir(pid)
+// Determine whether the worker named workerID is dead. Queues opened
+// with `Options.UseFileLock` check by attempting to flock its lock
+// file; other queues check by signalling the PID that names its
+// `cur` subdirectory, or by the lock file if that name is not a PID.
+func (q *Queue) workerIsDead(workerID string) (bool, error) {
+	if q.useFileLock {
+		return q.lockIsFree(workerID)
+	}
+	if pid, err := strconv.Atoi(workerID); err == nil {
+		exists, err := processExists(pid)
+		if err != nil {
+			q.logger.Errorw("kill -0 failed", err, "pid", pid, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
+			return false, err
+		}
+		return !exists, nil
+	}
+	return q.lockIsFree(workerID)
+}
+
+func (q *Queue) rescueDeadJobsFrom(workerID string) {
+	dir := q.getWorkerDir(workerID)
 	names, err := readdirnames(dir)
 	if err != nil {
-		log.Printf("Could not rescue dead jobs from pid %d: failed to read contents of %s\n", pid, dir)
+		q.logger.Errorw("could not rescue dead jobs: failed to read worker directory", err, "worker", workerID, "queue_dir", q.basedir, "op", "rescue_dead_jobs")
 	}
 	for _, s := range names {
-		if err := os.Rename(path.Join(dir, s), path.Join(q.getNewDir(), s)); err != nil {
-			log.Println("Failed to reschedule job", s, "from process", pid, "- error:", err)
+		src := path.Join(dir, s)
+		dst := path.Join(q.laneDir("new", q.jobLane(src)), s)
+		if q.rescueCountsAsAttempt {
+			attempts, err := q.incrementAttemptsIn(src)
+			if err != nil {
+				q.logger.Errorw("failed to record rescue attempt", err, "job", s, "worker", workerID, "op", "rescue_dead_jobs")
+			} else if attempts > q.maxRetries {
+				dst = path.Join(q.basedir, "failed", s)
+			}
+		}
+		if err := os.Rename(src, dst); err != nil {
+			q.logger.Errorw("failed to reschedule job", err, "job", s, "worker", workerID, "op", "rescue_dead_jobs")
 		} else {
-			log.Println("Rescueduled job", s, "from process", pid)
+			q.logger.Infow("rescheduled job", "job", s, "worker", workerID, "op", "rescue_dead_jobs")
 		}
 	}
 }
@@ -214,7 +470,15 @@ func (j *Job) Get(name string) ([]byte, error) {
 // Set a property of the job. This simply creates a file inside the
 // job's directory atomically.
 func (j *Job) Set(name string, data []byte) error {
-	q := j.q
+	return j.q.setProperty(j.dir, j.Basename, name, data)
+}
+
+// setProperty atomically creates file `name` with contents data
+// inside dir, by writing it to `tmp` and renaming it into place. dir
+// need not belong to a live *Job - RescueDeadJobs uses this to update
+// a dead worker's job directory directly - so the job's basename is
+// passed in separately, for logging only.
+func (q *Queue) setProperty(dir, basename, name string, data []byte) error {
 	f, err := ioutil.TempFile(path.Join(q.basedir, "tmp"), name)
 	if err != nil {
 		return err
@@ -228,9 +492,9 @@ func (j *Job) Set(name string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	newfn := path.Join(j.dir, name)
+	newfn := path.Join(dir, name)
 	if err := os.Rename(fn, newfn); err != nil {
-		log.Printf("Failed to rename %s to %s: %s\n", fn, newfn)
+		q.logger.Errorw("failed to rename property into place", err, "job", basename, "queue_dir", q.basedir, "op", "set", "from", fn, "to", newfn)
 		return err
 	}
 	return nil
@@ -256,11 +520,8 @@ func processExists(pid int) (bool, error) {
 	if err := syscall.Kill(pid, 0); err != nil {
 		if err == syscall.ESRCH {
 			return false, nil
-		} else {
-			log.Println("Kill failed for PID", pid, "- error:", err)
-			return false, err
 		}
-	} else {
-		return true, nil
+		return false, err
 	}
+	return true, nil
 }
@@ -0,0 +1,37 @@
+// Package pqueueslog adapts a log/slog.Logger to the pqueue.Logger
+// interface, so Queue events (dead workers, rescued jobs, property
+// write failures) come out as structured slog records instead of
+// going through pqueue's default stdlib-log adapter. Requires Go
+// 1.21 or later, for log/slog; callers on older Go can implement
+// pqueue.Logger directly instead.
+package pqueueslog
+
+import (
+	"log/slog"
+
+	"github.com/ljosa/go-pqueue/pqueue"
+)
+
+// Adapter implements pqueue.Logger on top of a *slog.Logger.
+type Adapter struct {
+	Logger *slog.Logger
+}
+
+var _ pqueue.Logger = Adapter{}
+
+// New wraps logger as a pqueue.Logger. If logger is nil, slog.Default()
+// is used.
+func New(logger *slog.Logger) Adapter {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return Adapter{Logger: logger}
+}
+
+func (a Adapter) Infow(msg string, kv ...interface{}) {
+	a.Logger.Info(msg, kv...)
+}
+
+func (a Adapter) Errorw(msg string, err error, kv ...interface{}) {
+	a.Logger.Error(msg, append([]interface{}{"error", err}, kv...)...)
+}
@@ -0,0 +1,37 @@
+package pqueueslog
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestInfowEmitsStructuredRecord(t *testing.T) {
+	var buf bytes.Buffer
+	a := New(slog.New(slog.NewTextHandler(&buf, nil)))
+	a.Infow("worker has gone away", "worker", "host-1-42", "op", "rescue_dead_jobs")
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=\"worker has gone away\"") {
+		t.Fatal("expected msg field in output, got", out)
+	}
+	if !strings.Contains(out, "worker=host-1-42") {
+		t.Fatal("expected worker field in output, got", out)
+	}
+}
+
+func TestErrorwIncludesError(t *testing.T) {
+	var buf bytes.Buffer
+	a := New(slog.New(slog.NewTextHandler(&buf, nil)))
+	a.Errorw("failed to rename property into place", errors.New("boom"), "job", "foo")
+
+	out := buf.String()
+	if !strings.Contains(out, "error=boom") {
+		t.Fatal("expected error field in output, got", out)
+	}
+	if !strings.Contains(out, "job=foo") {
+		t.Fatal("expected job field in output, got", out)
+	}
+}
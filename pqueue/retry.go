@@ -0,0 +1,104 @@
+package pqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetryBaseDelay is used by FailWithRetry when
+// Options.RetryBaseDelay is zero.
+const DefaultRetryBaseDelay = time.Second
+
+// maxRetryDelay caps the exponential backoff computed by
+// FailWithRetry so that a job with many attempts does not overflow
+// time.Duration or get delayed for an absurd length of time.
+const maxRetryDelay = time.Hour
+
+// FailWithRetry records cause as the reason this attempt failed and
+// either schedules another attempt or, once Options.MaxRetries is
+// exhausted, moves the job to `failed` like Fail does. The job's
+// attempt count and failure history are kept as properties
+// (`_attempts`, `_last_error`, `_failure_history`) so operators can
+// inspect why a job kept failing.
+func (job *Job) FailWithRetry(cause error) error {
+	attempts, err := job.incrementAttempts()
+	if err != nil {
+		return err
+	}
+	if err := job.recordFailure(attempts, cause); err != nil {
+		return err
+	}
+	if attempts > job.q.maxRetries {
+		return job.Fail()
+	}
+	return job.Reschedule(retryDelay(job.q.retryBaseDelay, attempts))
+}
+
+// retryDelay is the exponential backoff for the nth attempt:
+// base * 2^(n-1), capped at maxRetryDelay.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > 32 { // avoid overflowing the shift below
+		return maxRetryDelay
+	}
+	d := base << uint(attempt-1)
+	if d <= 0 || d > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return d
+}
+
+func (job *Job) incrementAttempts() (int, error) {
+	data, err := job.Get("_attempts")
+	attempts := 0
+	if err == nil {
+		attempts, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	attempts++
+	if err := job.Set("_attempts", []byte(strconv.Itoa(attempts))); err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
+
+func (job *Job) recordFailure(attempt int, cause error) error {
+	if err := job.Set("_last_error", []byte(cause.Error())); err != nil {
+		return err
+	}
+	history, err := job.Get("_failure_history")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	line := fmt.Sprintf("attempt %d: %s\n", attempt, cause.Error())
+	return job.Set("_failure_history", append(history, []byte(line)...))
+}
+
+// incrementAttemptsIn does what (*Job).incrementAttempts does, but
+// for a job directory that RescueDeadJobs is about to move rather
+// than one we have a live *Job for. It goes through the same
+// tmp-file-and-rename Set uses instead of writing `_attempts` in
+// place, because RescueDeadJobs can run concurrently from multiple
+// hosts against the same dead worker's jobs.
+func (q *Queue) incrementAttemptsIn(dir string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "_attempts"))
+	attempts := 0
+	if err == nil {
+		attempts, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	attempts++
+	if err := q.setProperty(dir, path.Base(dir), "_attempts", []byte(strconv.Itoa(attempts))); err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
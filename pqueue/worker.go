@@ -0,0 +1,73 @@
+package pqueue
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// WorkerID names a worker's subdirectory of `cur`. By default it is
+// just the worker's PID, which is only meaningful to a rescuer
+// running on the same host. For queues shared by workers on several
+// hosts (for example over NFS or SMB), pass a host-qualified WorkerID
+// together with `Options.UseFileLock` to `OpenQueueWithOptions`.
+type WorkerID string
+
+func defaultWorkerID() WorkerID {
+	return WorkerID(strconv.Itoa(os.Getpid()))
+}
+
+// NewWorkerID returns a WorkerID of the form `hostname-pid-random`,
+// unique enough to identify this worker among others on any host
+// sharing the queue. Use it with `Options.UseFileLock` so that a
+// rescuer on a different host can tell this worker apart from its
+// own.
+func NewWorkerID() WorkerID {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return WorkerID(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), rand.Int63()))
+}
+
+// Create (if necessary) and flock cur/<workerID>.lock for the
+// lifetime of the Queue. The lock is held LOCK_EX|LOCK_NB, so a
+// rescuer elsewhere can detect that the worker has gone away simply
+// by being able to acquire the same lock.
+func (q *Queue) acquireLock(workerID WorkerID) (*os.File, error) {
+	f, err := os.OpenFile(q.lockPath(string(workerID)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockIsFree reports whether nobody currently holds
+// cur/<workerID>.lock, which we take to mean that the worker that
+// held it is gone.
+func (q *Queue) lockIsFree(workerID string) (bool, error) {
+	f, err := os.OpenFile(q.lockPath(workerID), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true, nil
+}
+
+func (q *Queue) lockPath(workerID string) string {
+	return q.getWorkerDir(workerID) + ".lock"
+}
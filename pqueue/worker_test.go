@@ -0,0 +1,141 @@
+package pqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// TestRescueDeadJobsFileLock simulates a worker on a different host
+// holding cur/<workerID>.lock via a goroutine (rather than a PID this
+// process could signal) and checks that RescueDeadJobs leaves its
+// jobs alone while the lock is held, but rescues them once it is
+// released.
+func TestRescueDeadJobsFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_rescue_file_lock_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueueWithOptions(dir, Options{WorkerID: NewWorkerID(), UseFileLock: true})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	otherWorker := "otherhost-99999-1"
+	if err := os.Mkdir(q.getWorkerDir(otherWorker), 0755); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+	if err := os.Mkdir(path.Join(q.getWorkerDir(otherWorker), "job1"), 0755); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+
+	lockf, err := os.OpenFile(q.lockPath(otherWorker), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal("OpenFile", err)
+	}
+	defer lockf.Close()
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := syscall.Flock(int(lockf.Fd()), syscall.LOCK_EX); err != nil {
+			t.Error("Flock", err)
+		}
+		close(held)
+		<-release
+		syscall.Flock(int(lockf.Fd()), syscall.LOCK_UN)
+	}()
+	<-held
+
+	if err := q.RescueDeadJobs(); err != nil {
+		t.Fatal("RescueDeadJobs", err)
+	}
+	if _, err := os.Stat(path.Join(q.getWorkerDir(otherWorker), "job1")); os.IsNotExist(err) {
+		t.Fatal("job of live (simulated) worker was rescued")
+	}
+
+	close(release)
+	<-done // wait for the goroutine to release the flock before lockf is closed
+
+	lockf2, err := os.OpenFile(q.lockPath(otherWorker), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal("OpenFile", err)
+	}
+	syscall.Flock(int(lockf2.Fd()), syscall.LOCK_EX)
+	syscall.Flock(int(lockf2.Fd()), syscall.LOCK_UN)
+	lockf2.Close()
+
+	if err := q.RescueDeadJobs(); err != nil {
+		t.Fatal("RescueDeadJobs", err)
+	}
+	if _, err := os.Stat(path.Join(q.basedir, "new", "job1")); os.IsNotExist(err) {
+		t.Fatal("job of dead worker was not rescued")
+	}
+}
+
+// TestRescueDeadJobsFileLockDefaultWorkerID is like
+// TestRescueDeadJobsFileLock, but opens the rescuing Queue with
+// UseFileLock and the default (PID-shaped) WorkerID, and simulates
+// the other worker under a numeric ID too. workerIsDead must still
+// check the lock rather than guessing from the ID's shape that it
+// can signal a PID on this host - otherwise a live cross-host worker
+// whose ID happens to look numeric would be declared dead just
+// because no such PID exists here.
+func TestRescueDeadJobsFileLockDefaultWorkerID(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test_rescue_file_lock_default_")
+	if err != nil {
+		t.Fatal("failed to create temp dir for queue", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueueWithOptions(dir, Options{UseFileLock: true})
+	if err != nil {
+		t.Fatal("OpenQueueWithOptions", err)
+	}
+	defer q.Close()
+
+	otherWorker := "999999"
+	if err := os.Mkdir(q.getWorkerDir(otherWorker), 0755); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+	if err := os.Mkdir(path.Join(q.getWorkerDir(otherWorker), "job1"), 0755); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+
+	lockf, err := os.OpenFile(q.lockPath(otherWorker), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal("OpenFile", err)
+	}
+	defer lockf.Close()
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := syscall.Flock(int(lockf.Fd()), syscall.LOCK_EX); err != nil {
+			t.Error("Flock", err)
+		}
+		close(held)
+		<-release
+		syscall.Flock(int(lockf.Fd()), syscall.LOCK_UN)
+	}()
+	<-held
+
+	if err := q.RescueDeadJobs(); err != nil {
+		t.Fatal("RescueDeadJobs", err)
+	}
+	if _, err := os.Stat(path.Join(q.getWorkerDir(otherWorker), "job1")); os.IsNotExist(err) {
+		t.Fatal("job of live (simulated) worker was rescued despite its numeric-looking WorkerID")
+	}
+
+	close(release)
+	<-done
+}